@@ -0,0 +1,147 @@
+package caddy_blocker
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func init() {
+	caddy.RegisterModule(AdminBlocked{})
+}
+
+// AdminBlocked exposes every provisioned blocker instance's tracked IPs on
+// the admin API under /blocker/, for inspection, manual unblocking, and
+// force-blocking. This covers all three algorithms: the fixed algorithm's
+// Storage is consulted directly, and sliding_window/token_bucket are
+// reached through their rateLimiter's own StorageLister/limiterUnblocker/
+// limiterForceBlocker implementations.
+type AdminBlocked struct{}
+
+// CaddyModule returns the Caddy module information.
+func (AdminBlocked) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "admin.api.blocker",
+		New: func() caddy.Module { return new(AdminBlocked) },
+	}
+}
+
+// Routes implements caddy.AdminRouter.
+func (AdminBlocked) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{
+		{
+			Pattern: "/blocker/blocked",
+			Handler: caddy.AdminHandlerFunc(handleListBlocked),
+		},
+		{
+			Pattern: "/blocker/blocked/",
+			Handler: caddy.AdminHandlerFunc(handleBlockedIP),
+		},
+	}
+}
+
+// handleListBlocked implements GET /blocker/blocked.
+func handleListBlocked(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{HTTPStatus: http.StatusMethodNotAllowed, Err: fmt.Errorf("method not allowed")}
+	}
+
+	seen := map[string]BlockedEntry{}
+	for _, inst := range instancesSnapshot() {
+		listers := []StorageLister{}
+		if l, ok := inst.storage.(StorageLister); ok {
+			listers = append(listers, l)
+		}
+		if l, ok := inst.limiter.(StorageLister); ok {
+			listers = append(listers, l)
+		}
+		for _, lister := range listers {
+			entries, err := lister.List()
+			if err != nil {
+				return caddy.APIError{HTTPStatus: http.StatusInternalServerError, Err: err}
+			}
+			for _, e := range entries {
+				if cur, ok := seen[e.IP]; !ok || e.ExpiresAt.After(cur.ExpiresAt) {
+					seen[e.IP] = e
+				}
+			}
+		}
+	}
+
+	out := make([]BlockedEntry, 0, len(seen))
+	for _, e := range seen {
+		out = append(out, e)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(out)
+}
+
+// handleBlockedIP implements DELETE and POST /blocker/blocked/{ip}.
+func handleBlockedIP(w http.ResponseWriter, r *http.Request) error {
+	ip := strings.TrimPrefix(r.URL.Path, "/blocker/blocked/")
+	if ip == "" {
+		return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: fmt.Errorf("missing ip in path")}
+	}
+
+	switch r.Method {
+	case http.MethodDelete:
+		for _, inst := range instancesSnapshot() {
+			switch {
+			case inst.storage != nil:
+				if err := inst.storage.Delete(ip); err != nil {
+					return caddy.APIError{HTTPStatus: http.StatusInternalServerError, Err: err}
+				}
+			default:
+				if u, ok := inst.limiter.(limiterUnblocker); ok {
+					if err := u.Unblock(ip); err != nil {
+						return caddy.APIError{HTTPStatus: http.StatusInternalServerError, Err: err}
+					}
+				}
+			}
+		}
+		w.WriteHeader(http.StatusOK)
+		return nil
+
+	case http.MethodPost:
+		var body struct {
+			Duration string `json:"duration"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: err}
+		}
+		ttl, err := caddy.ParseDuration(body.Duration)
+		if err != nil {
+			return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: fmt.Errorf("invalid duration: %v", err)}
+		}
+		for _, inst := range instancesSnapshot() {
+			switch {
+			case inst.storage != nil:
+				for i := 0; i <= inst.MaxUnAuthTimes; i++ {
+					if _, err := inst.storage.Incr(ip, ttl); err != nil {
+						return caddy.APIError{HTTPStatus: http.StatusInternalServerError, Err: err}
+					}
+				}
+			default:
+				if fb, ok := inst.limiter.(limiterForceBlocker); ok {
+					if err := fb.ForceBlock(ip, ttl); err != nil {
+						return caddy.APIError{HTTPStatus: http.StatusInternalServerError, Err: err}
+					}
+				}
+			}
+		}
+		w.WriteHeader(http.StatusOK)
+		return nil
+
+	default:
+		return caddy.APIError{HTTPStatus: http.StatusMethodNotAllowed, Err: fmt.Errorf("method not allowed")}
+	}
+}
+
+// Interface guards
+var (
+	_ caddy.Module      = (*AdminBlocked)(nil)
+	_ caddy.AdminRouter = (*AdminBlocked)(nil)
+)
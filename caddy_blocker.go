@@ -1,21 +1,28 @@
 package caddy_blocker
 
 import (
+	"encoding/json"
 	"fmt"
-	"io"
 	"net"
 	"net/http"
 	"os"
 	"strconv"
+	"sync/atomic"
 	"time"
 
 	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
-	"github.com/projectdiscovery/expirablelru"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
 )
 
+// nextInstanceID hands out unique identifiers for provisioned Middleware
+// instances, so the admin API can track and release them.
+var nextInstanceID uint64
+
 func init() {
 	caddy.RegisterModule(Middleware{})
 	httpcaddyfile.RegisterHandlerDirective("blocker", parseCaddyfile)
@@ -35,19 +42,77 @@ func (lrw *loggingResponseWriter) WriteHeader(code int) {
 	lrw.ResponseWriter.WriteHeader(code)
 }
 
-// Middleware implements an HTTP handler that writes the
-// visitor's IP address to a file or stream.
+// BlockedResponse configures what a blocked or denylisted client receives.
+type BlockedResponse struct {
+	Status  int         `json:"status,omitempty"`
+	Headers http.Header `json:"headers,omitempty"`
+
+	// Body is the response body template, evaluated through the
+	// request's replacer at serve time. The Caddyfile's body_file
+	// option reads the file once, at config-load time, and stores its
+	// contents here same as a literal body would.
+	Body string `json:"body,omitempty"`
+}
+
+// Middleware implements an HTTP handler that counts failed-auth responses
+// per client IP and blocks clients that cross a configured threshold.
 type Middleware struct {
-	MaxUnAuthTimes string `json:"max_unauth_times"`
-	maxUnAuthTimes int
+	CacheSize      int            `json:"cache_size,omitempty"`
+	MaxUnAuthTimes int            `json:"max_unauth_times,omitempty"`
+	BlockDuration  caddy.Duration `json:"block_duration,omitempty"`
+
+	// TriggerStatuses lists the response statuses that count against a
+	// client; defaults to 401 and 403.
+	TriggerStatuses []int `json:"trigger_statuses,omitempty"`
+
+	// Response controls what a blocked or denylisted client sees; Status
+	// defaults to 401 and Body is evaluated through the request's replacer.
+	Response BlockedResponse `json:"response,omitempty"`
+
+	// ClientIPHeaders, when set, are consulted in order (ahead of
+	// RemoteAddr) to determine the real client IP behind a proxy. The
+	// first header present on the request that yields an untrusted
+	// address wins.
+	ClientIPHeaders []string `json:"client_ip_headers,omitempty"`
+
+	// TrustedProxies lists CIDRs whose RemoteAddr is trusted to supply
+	// ClientIPHeaders.
+	TrustedProxies []string `json:"trusted_proxies,omitempty"`
+
+	// Allowlist and Denylist are CIDRs evaluated before the LRU lookup.
+	// Allowlisted clients bypass counting entirely; denylisted clients
+	// are rejected immediately without touching the cache.
+	Allowlist []string `json:"allowlist,omitempty"`
+	Denylist  []string `json:"denylist,omitempty"`
+
+	// StorageRaw is the storage module backing the block counters when
+	// Algorithm is "fixed" (the default), shared across a cluster when
+	// it isn't the default in-process module.
+	StorageRaw json.RawMessage `json:"storage,omitempty" caddy:"namespace=http.handlers.blocker.storage inline_key=backend"`
 
-	BlockDuration string `json:"block_duration"`
-	blockDuration time.Duration
+	// Algorithm selects how triggering events are counted: "fixed" (the
+	// default, single counter refreshed on every event), "sliding_window"
+	// (count of events within the trailing block_duration), or
+	// "token_bucket" (refill at Rate, capped at Burst).
+	Algorithm string `json:"algorithm,omitempty"`
 
-	CacheSize string `json:"cache_size"`
-	lruCache  *expirablelru.Cache
+	// Rate is the token refill rate, in tokens/sec, for the token_bucket
+	// algorithm.
+	Rate float64 `json:"rate,omitempty"`
 
-	w io.Writer
+	// Burst is the token_bucket capacity; defaults to max_unauth_times.
+	Burst int `json:"burst,omitempty"`
+
+	allowlist      []*net.IPNet
+	denylist       []*net.IPNet
+	trustedProxies []*net.IPNet
+
+	id              uint64
+	storage         Storage
+	limiter         rateLimiter
+	metrics         *blockerMetrics
+	metricsRegistry *prometheus.Registry
+	logger          *zap.Logger
 }
 
 // CaddyModule returns the Caddy module information.
@@ -60,66 +125,392 @@ func (Middleware) CaddyModule() caddy.ModuleInfo {
 
 // Provision implements caddy.Provisioner.
 func (m *Middleware) Provision(ctx caddy.Context) error {
+	m.logger = ctx.Logger(m)
+	m.metricsRegistry = ctx.GetMetricsRegistry()
+	m.metrics = newMetrics(ctx)
+
+	if m.CacheSize <= 0 {
+		return fmt.Errorf("cache_size must be a positive integer, got %d", m.CacheSize)
+	}
+	if m.BlockDuration <= 0 {
+		return fmt.Errorf("block_duration must be a positive duration, got %v", m.BlockDuration)
+	}
+	if len(m.TriggerStatuses) == 0 {
+		m.TriggerStatuses = []int{http.StatusUnauthorized, http.StatusForbidden}
+	}
+	if m.Response.Status == 0 {
+		m.Response.Status = http.StatusUnauthorized
+	}
+
 	var err error
-	m.blockDuration, err = time.ParseDuration(m.BlockDuration)
-	if err != nil {
-		return fmt.Errorf("block_duration is wrong with value: %v", m.BlockDuration)
+	if m.allowlist, err = parseCIDRs(m.Allowlist); err != nil {
+		return fmt.Errorf("allowlist: %v", err)
 	}
-	cacheSize, err := strconv.Atoi(m.CacheSize)
-	if err != nil {
-		return fmt.Errorf("cache_size is wrong with value: %v", m.CacheSize)
+	if m.denylist, err = parseCIDRs(m.Denylist); err != nil {
+		return fmt.Errorf("denylist: %v", err)
+	}
+	if m.trustedProxies, err = parseCIDRs(m.TrustedProxies); err != nil {
+		return fmt.Errorf("trusted_proxies: %v", err)
 	}
-	m.lruCache = expirablelru.NewExpirableLRU(cacheSize, nil, m.blockDuration, 0)
 
-	m.maxUnAuthTimes, err = strconv.Atoi(m.MaxUnAuthTimes)
-	if err != nil {
-		return fmt.Errorf("max_unauth_times is wrong with value: %v", m.MaxUnAuthTimes)
+	if m.Algorithm == "" {
+		m.Algorithm = "fixed"
 	}
+	switch m.Algorithm {
+	case "fixed":
+		if m.StorageRaw != nil {
+			mod, err := ctx.LoadModule(m, "StorageRaw")
+			if err != nil {
+				return fmt.Errorf("loading blocker storage module: %v", err)
+			}
+			storage, ok := mod.(Storage)
+			if !ok {
+				return fmt.Errorf("module %T is not a blocker.Storage", mod)
+			}
+			m.storage = storage
+		} else {
+			inmemory := &InMemoryStorage{CacheSize: m.CacheSize}
+			if err := inmemory.Provision(ctx); err != nil {
+				return err
+			}
+			m.storage = inmemory
+		}
+		m.limiter = &storageLimiter{
+			storage:        m.storage,
+			maxUnAuthTimes: m.MaxUnAuthTimes,
+			blockDuration:  time.Duration(m.BlockDuration),
+		}
+
+	case "sliding_window":
+		m.limiter = newSlidingWindowLimiter(m.MaxUnAuthTimes, m.CacheSize, time.Duration(m.BlockDuration))
+
+	case "token_bucket":
+		if m.Rate <= 0 {
+			return fmt.Errorf("token_bucket algorithm requires a positive rate, got %v", m.Rate)
+		}
+		burst := m.Burst
+		if burst <= 0 {
+			burst = m.MaxUnAuthTimes
+		}
+		m.limiter = newTokenBucketLimiter(m.Rate, burst, m.CacheSize)
+
+	default:
+		return fmt.Errorf("unrecognized algorithm %q", m.Algorithm)
+	}
+
+	m.id = atomic.AddUint64(&nextInstanceID, 1)
+	registerInstance(m)
 
-	m.w = os.Stdout
 	return nil
 }
 
-// Validate implements caddy.Validator.
-func (m *Middleware) Validate() error {
-	if m.w == nil {
-		return fmt.Errorf("no writer")
-	}
+// Cleanup implements caddy.CleanerUpper.
+func (m *Middleware) Cleanup() error {
+	unregisterInstance(m.id)
+	releaseMetrics(m.metricsRegistry)
 	return nil
 }
 
+// parseCIDRs parses cidrs into IP networks, rejecting anything malformed.
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %v", cidr, err)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// containsIP reports whether any network in nets contains ip.
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// triggersBlock reports whether status counts against the client.
+func (m Middleware) triggersBlock(status int) bool {
+	for _, s := range m.TriggerStatuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// writeBlockedResponse answers a blocked or denylisted request according to
+// m.Response, templating the body through the request's replacer and
+// advertising retryAfter via the Retry-After header.
+func (m Middleware) writeBlockedResponse(w http.ResponseWriter, r *http.Request, retryAfter time.Duration) {
+	for field, values := range m.Response.Headers {
+		for _, v := range values {
+			w.Header().Add(field, v)
+		}
+	}
+	if retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())))
+	}
+	w.WriteHeader(m.Response.Status)
+	if m.Response.Body == "" {
+		return
+	}
+	repl, ok := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	if !ok {
+		repl = caddy.NewReplacer()
+	}
+	w.Write([]byte(repl.ReplaceAll(m.Response.Body, "")))
+}
+
 // ServeHTTP implements caddyhttp.MiddlewareHandler.
 func (m Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
-	ip, port, _ := net.SplitHostPort(r.RemoteAddr)
-	var unAuthTimes int
-	if v, ok := m.lruCache.Get(ip); ok {
-		unAuthTimes = v.(int)
+	_, port, _ := net.SplitHostPort(r.RemoteAddr)
+	clientIP := m.resolveClientIP(r)
+	ip := clientIP.String()
+
+	if containsIP(m.denylist, clientIP) {
+		m.logger.Info("blocker.denylisted", zap.String("client_ip", ip))
+		m.metrics.blocks.Inc()
+		m.writeBlockedResponse(w, r, time.Duration(m.BlockDuration))
+		return nil
+	}
+	if containsIP(m.allowlist, clientIP) {
+		m.metrics.bypassedAllowlist.Inc()
+		return next.ServeHTTP(w, r)
+	}
+
+	blocked, retryAfter, err := m.limiter.check(ip)
+	if err != nil {
+		return err
 	}
-	if unAuthTimes > m.maxUnAuthTimes {
-		w.WriteHeader(http.StatusUnauthorized)
+	if blocked {
+		m.writeBlockedResponse(w, r, retryAfter)
 		return nil
 	}
 
 	lrw := NewLoggingResponseWriter(w)
-	err := next.ServeHTTP(lrw, r)
-	if err != nil {
+	if err := next.ServeHTTP(lrw, r); err != nil {
 		return err
 	}
 
-	switch lrw.statusCode {
-	case http.StatusUnauthorized, http.StatusForbidden:
-		m.lruCache.Add(ip, unAuthTimes+1)
-		m.w.Write([]byte(fmt.Sprintf("!!!! %v, %v, %v", lrw.statusCode, ip, port)))
+	if m.triggersBlock(lrw.statusCode) {
+		m.metrics.unauthEvents.WithLabelValues(strconv.Itoa(lrw.statusCode)).Inc()
+		blocked, retryAfter, err = m.limiter.record(ip)
+		if err != nil {
+			return err
+		}
+		if sz, ok := m.limiter.(sizer); ok {
+			m.metrics.trackedIPs.Set(float64(sz.Len()))
+		}
+		event := "blocker.unauth_recorded"
+		if blocked {
+			event = "blocker.blocked"
+			m.metrics.blocks.Inc()
+		}
+		m.logger.Info(event,
+			zap.String("client_ip", ip),
+			zap.String("client_port", port),
+			zap.Int("status_code", lrw.statusCode),
+			zap.String("request_uri", r.RequestURI),
+			zap.String("host", r.Host),
+			zap.String("user_agent", r.UserAgent()),
+			zap.Bool("blocked", blocked),
+			zap.Duration("retry_after", retryAfter),
+		)
 	}
 	return nil
 }
 
 // UnmarshalCaddyfile implements caddyfile.Unmarshaler.
+//
+// Syntax:
+//
+//	blocker {
+//	    cache_size       <int>
+//	    max_unauth_times <int>
+//	    block_duration   <duration>
+//	    trigger_status   <status>...
+//	    response {
+//	        status    <int>
+//	        header    <field> <value>
+//	        body      <template>
+//	        body_file <path>
+//	    }
+//	    client_ip_header <field>...
+//	    trusted_proxies  <cidr>...
+//	    allowlist        <cidr>...
+//	    denylist         <cidr>...
+//	    storage <module> {
+//	        ...
+//	    }
+//	    algorithm fixed|sliding_window|token_bucket
+//	    rate      <tokens_per_sec>
+//	    burst     <int>
+//	}
 func (m *Middleware) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	for d.Next() {
-		if !d.Args(&m.CacheSize, &m.MaxUnAuthTimes, &m.BlockDuration) {
+		if d.NextArg() {
 			return d.ArgErr()
 		}
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			switch d.Val() {
+			case "cache_size":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				size, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("invalid cache_size %q: %v", d.Val(), err)
+				}
+				m.CacheSize = size
+
+			case "max_unauth_times":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				times, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("invalid max_unauth_times %q: %v", d.Val(), err)
+				}
+				m.MaxUnAuthTimes = times
+
+			case "block_duration":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				dur, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("invalid block_duration %q: %v", d.Val(), err)
+				}
+				m.BlockDuration = caddy.Duration(dur)
+
+			case "trigger_status":
+				args := d.RemainingArgs()
+				if len(args) == 0 {
+					return d.ArgErr()
+				}
+				for _, a := range args {
+					status, err := strconv.Atoi(a)
+					if err != nil {
+						return d.Errf("invalid trigger_status %q: %v", a, err)
+					}
+					m.TriggerStatuses = append(m.TriggerStatuses, status)
+				}
+
+			case "response":
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					switch d.Val() {
+					case "status":
+						if !d.NextArg() {
+							return d.ArgErr()
+						}
+						status, err := strconv.Atoi(d.Val())
+						if err != nil {
+							return d.Errf("invalid response status %q: %v", d.Val(), err)
+						}
+						m.Response.Status = status
+					case "header":
+						args := d.RemainingArgs()
+						if len(args) != 2 {
+							return d.ArgErr()
+						}
+						if m.Response.Headers == nil {
+							m.Response.Headers = http.Header{}
+						}
+						m.Response.Headers.Add(args[0], args[1])
+					case "body":
+						if !d.NextArg() {
+							return d.ArgErr()
+						}
+						m.Response.Body = d.Val()
+					case "body_file":
+						if !d.NextArg() {
+							return d.ArgErr()
+						}
+						data, err := os.ReadFile(d.Val())
+						if err != nil {
+							return d.Errf("reading response body_file %q: %v", d.Val(), err)
+						}
+						m.Response.Body = string(data)
+					default:
+						return d.ArgErr()
+					}
+				}
+
+			case "client_ip_header":
+				args := d.RemainingArgs()
+				if len(args) == 0 {
+					return d.ArgErr()
+				}
+				m.ClientIPHeaders = append(m.ClientIPHeaders, args...)
+
+			case "trusted_proxies":
+				args := d.RemainingArgs()
+				if len(args) == 0 {
+					return d.ArgErr()
+				}
+				m.TrustedProxies = append(m.TrustedProxies, args...)
+
+			case "allowlist":
+				args := d.RemainingArgs()
+				if len(args) == 0 {
+					return d.ArgErr()
+				}
+				m.Allowlist = append(m.Allowlist, args...)
+
+			case "denylist":
+				args := d.RemainingArgs()
+				if len(args) == 0 {
+					return d.ArgErr()
+				}
+				m.Denylist = append(m.Denylist, args...)
+
+			case "storage":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				modName := d.Val()
+				unm, err := caddyfile.UnmarshalModule(d, "http.handlers.blocker.storage."+modName)
+				if err != nil {
+					return err
+				}
+				m.StorageRaw = caddyconfig.JSONModuleObject(unm, "backend", modName, nil)
+
+			case "algorithm":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.Algorithm = d.Val()
+
+			case "rate":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				rate, err := strconv.ParseFloat(d.Val(), 64)
+				if err != nil {
+					return d.Errf("invalid rate %q: %v", d.Val(), err)
+				}
+				m.Rate = rate
+
+			case "burst":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				burst, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("invalid burst %q: %v", d.Val(), err)
+				}
+				m.Burst = burst
+
+			default:
+				return d.ArgErr()
+			}
+		}
 	}
 	return nil
 }
@@ -134,7 +525,7 @@ func parseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error)
 // Interface guards
 var (
 	_ caddy.Provisioner           = (*Middleware)(nil)
-	_ caddy.Validator             = (*Middleware)(nil)
+	_ caddy.CleanerUpper          = (*Middleware)(nil)
 	_ caddyhttp.MiddlewareHandler = (*Middleware)(nil)
 	_ caddyfile.Unmarshaler       = (*Middleware)(nil)
 )
@@ -0,0 +1,188 @@
+package caddy_blocker
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/certmagic"
+)
+
+func init() {
+	caddy.RegisterModule(CaddyStorage{})
+}
+
+// CaddyStorage persists block counters through Caddy's configured
+// certificate storage (file, Redis, Consul, etcd, ...), so every Caddy
+// instance pointed at the same storage shares block state.
+type CaddyStorage struct {
+	// Namespace partitions the keyspace this instance reads and writes,
+	// so multiple independent "blocker" directives pointed at the same
+	// shared storage backend don't merge their counters for the same
+	// client IP. Defaults to "default"; instances meant to share state
+	// (the usual case, for a cluster) should share a namespace too.
+	Namespace string `json:"namespace,omitempty"`
+
+	storage certmagic.Storage
+}
+
+// storageRecord is the JSON document kept per IP. IP is carried in the
+// record itself, rather than recovered from the storage key, since the
+// key mangles characters that aren't safe in a generic storage namespace.
+type storageRecord struct {
+	IP        string    `json:"ip"`
+	Count     int       `json:"count"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// CaddyModule returns the Caddy module information.
+func (CaddyStorage) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.blocker.storage.caddy_storage",
+		New: func() caddy.Module { return new(CaddyStorage) },
+	}
+}
+
+// Provision implements caddy.Provisioner.
+func (s *CaddyStorage) Provision(ctx caddy.Context) error {
+	s.storage = ctx.Storage()
+	if s.Namespace == "" {
+		s.Namespace = "default"
+	}
+	return nil
+}
+
+// key maps ip to a storage key under the blocker's own, namespaced prefix.
+func (s *CaddyStorage) key(ip string) string {
+	return "blocker/" + s.Namespace + "/" + strings.ReplaceAll(strings.ReplaceAll(ip, ":", "_"), "/", "_")
+}
+
+// prefix returns the storage prefix this instance lists under.
+func (s *CaddyStorage) prefix() string {
+	return "blocker/" + s.Namespace + "/"
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler.
+//
+//	storage caddy_storage {
+//	    namespace <name>
+//	}
+func (s *CaddyStorage) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			switch d.Val() {
+			case "namespace":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				s.Namespace = d.Val()
+			default:
+				return d.ArgErr()
+			}
+		}
+	}
+	return nil
+}
+
+// load reads and decodes ip's record, treating an expired or missing
+// record as absent.
+func (s *CaddyStorage) load(ctx context.Context, ip string) (storageRecord, bool, error) {
+	key := s.key(ip)
+	if !s.storage.Exists(ctx, key) {
+		return storageRecord{}, false, nil
+	}
+	data, err := s.storage.Load(ctx, key)
+	if err != nil {
+		return storageRecord{}, false, err
+	}
+	var rec storageRecord
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return storageRecord{}, false, err
+	}
+	if !time.Now().Before(rec.ExpiresAt) {
+		return storageRecord{}, false, nil
+	}
+	return rec, true, nil
+}
+
+// Incr implements Storage. The read-modify-write is wrapped in the
+// storage's own distributed lock, since two instances racing to increment
+// the same IP would otherwise both load the same count and one update
+// would be lost.
+func (s *CaddyStorage) Incr(ip string, ttl time.Duration) (int, error) {
+	ctx := context.Background()
+	key := s.key(ip)
+	if err := s.storage.Lock(ctx, key); err != nil {
+		return 0, err
+	}
+	defer s.storage.Unlock(ctx, key)
+
+	rec, _, err := s.load(ctx, ip)
+	if err != nil {
+		return 0, err
+	}
+	rec.IP = ip
+	rec.Count++
+	rec.ExpiresAt = time.Now().Add(ttl)
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return 0, err
+	}
+	if err := s.storage.Store(ctx, key, data); err != nil {
+		return 0, err
+	}
+	return rec.Count, nil
+}
+
+// Get implements Storage.
+func (s *CaddyStorage) Get(ip string) (int, time.Duration, error) {
+	rec, ok, err := s.load(context.Background(), ip)
+	if err != nil || !ok {
+		return 0, 0, err
+	}
+	return rec.Count, time.Until(rec.ExpiresAt), nil
+}
+
+// Delete implements Storage.
+func (s *CaddyStorage) Delete(ip string) error {
+	ctx := context.Background()
+	key := s.key(ip)
+	if !s.storage.Exists(ctx, key) {
+		return nil
+	}
+	return s.storage.Delete(ctx, key)
+}
+
+// List implements StorageLister.
+func (s *CaddyStorage) List() ([]BlockedEntry, error) {
+	ctx := context.Background()
+	keys, err := s.storage.List(ctx, s.prefix(), false)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	entries := make([]BlockedEntry, 0, len(keys))
+	for _, key := range keys {
+		data, err := s.storage.Load(ctx, key)
+		if err != nil {
+			continue
+		}
+		var rec storageRecord
+		if err := json.Unmarshal(data, &rec); err != nil || !now.Before(rec.ExpiresAt) {
+			continue
+		}
+		entries = append(entries, BlockedEntry{IP: rec.IP, Count: rec.Count, ExpiresAt: rec.ExpiresAt})
+	}
+	return entries, nil
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner     = (*CaddyStorage)(nil)
+	_ caddyfile.Unmarshaler = (*CaddyStorage)(nil)
+	_ Storage               = (*CaddyStorage)(nil)
+	_ StorageLister         = (*CaddyStorage)(nil)
+)
@@ -0,0 +1,48 @@
+package caddy_blocker
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// resolveClientIP determines the IP address to key the block counter on.
+// If RemoteAddr falls inside a trusted proxy CIDR, ClientIPHeaders is
+// consulted in order, and each one present on the request is walked
+// right-to-left, skipping hops that are themselves trusted proxies, until
+// an untrusted address is found. If none is found, or RemoteAddr isn't a
+// trusted proxy, RemoteAddr is used as-is.
+func (m Middleware) resolveClientIP(r *http.Request) net.IP {
+	remoteIP := normalizeIP(r.RemoteAddr)
+	if remoteIP == nil || !containsIP(m.trustedProxies, remoteIP) {
+		return remoteIP
+	}
+
+	for _, headerName := range m.ClientIPHeaders {
+		header := r.Header.Get(headerName)
+		if header == "" {
+			continue
+		}
+		hops := strings.Split(header, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := normalizeIP(strings.TrimSpace(hops[i]))
+			if hop == nil || containsIP(m.trustedProxies, hop) {
+				continue
+			}
+			return hop
+		}
+	}
+	return remoteIP
+}
+
+// normalizeIP parses an address that may carry a port and/or an IPv6 zone,
+// returning the bare, canonical IP.
+func normalizeIP(addr string) net.IP {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	if zone := strings.IndexByte(addr, '%'); zone != -1 {
+		addr = addr[:zone]
+	}
+	return net.ParseIP(addr)
+}
@@ -0,0 +1,138 @@
+package caddy_blocker
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/projectdiscovery/expirablelru"
+)
+
+func init() {
+	caddy.RegisterModule(InMemoryStorage{})
+}
+
+// InMemoryStorage is the default Storage backend: a size-bounded LRU local
+// to this Caddy instance. Counters aren't shared across a cluster.
+type InMemoryStorage struct {
+	CacheSize int `json:"cache_size,omitempty"`
+
+	cache *expirablelru.Cache
+}
+
+// inmemoryEntry is the value stored per IP; ttl is tracked per-entry since
+// Incr is called with a caller-supplied ttl rather than a fixed cache-wide
+// one.
+type inmemoryEntry struct {
+	count     int
+	expiresAt time.Time
+}
+
+// CaddyModule returns the Caddy module information.
+func (InMemoryStorage) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.blocker.storage.inmemory",
+		New: func() caddy.Module { return new(InMemoryStorage) },
+	}
+}
+
+// Provision implements caddy.Provisioner.
+func (s *InMemoryStorage) Provision(_ caddy.Context) error {
+	if s.CacheSize <= 0 {
+		s.CacheSize = 10000
+	}
+	s.cache = expirablelru.NewExpirableLRU(s.CacheSize, nil, 0, 0)
+	return nil
+}
+
+// Incr implements Storage.
+func (s *InMemoryStorage) Incr(ip string, ttl time.Duration) (int, error) {
+	count := 1
+	if v, ok := s.cache.Get(ip); ok {
+		if e := v.(inmemoryEntry); time.Now().Before(e.expiresAt) {
+			count = e.count + 1
+		}
+	}
+	s.cache.Add(ip, inmemoryEntry{count: count, expiresAt: time.Now().Add(ttl)})
+	return count, nil
+}
+
+// Get implements Storage.
+func (s *InMemoryStorage) Get(ip string) (int, time.Duration, error) {
+	v, ok := s.cache.Get(ip)
+	if !ok {
+		return 0, 0, nil
+	}
+	e := v.(inmemoryEntry)
+	remaining := time.Until(e.expiresAt)
+	if remaining <= 0 {
+		s.cache.Remove(ip)
+		return 0, 0, nil
+	}
+	return e.count, remaining, nil
+}
+
+// Delete implements Storage.
+func (s *InMemoryStorage) Delete(ip string) error {
+	s.cache.Remove(ip)
+	return nil
+}
+
+// Len implements sizer.
+func (s *InMemoryStorage) Len() int {
+	return s.cache.Len()
+}
+
+// List implements StorageLister.
+func (s *InMemoryStorage) List() ([]BlockedEntry, error) {
+	now := time.Now()
+	keys := s.cache.Keys()
+	entries := make([]BlockedEntry, 0, len(keys))
+	for _, key := range keys {
+		v, ok := s.cache.Peek(key)
+		if !ok {
+			continue
+		}
+		e := v.(inmemoryEntry)
+		if !now.Before(e.expiresAt) {
+			continue
+		}
+		entries = append(entries, BlockedEntry{IP: key.(string), Count: e.count, ExpiresAt: e.expiresAt})
+	}
+	return entries, nil
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler.
+//
+//	storage inmemory {
+//	    cache_size <int>
+//	}
+func (s *InMemoryStorage) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			switch d.Val() {
+			case "cache_size":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				size, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("invalid cache_size %q: %v", d.Val(), err)
+				}
+				s.CacheSize = size
+			default:
+				return d.ArgErr()
+			}
+		}
+	}
+	return nil
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner     = (*InMemoryStorage)(nil)
+	_ caddyfile.Unmarshaler = (*InMemoryStorage)(nil)
+	_ Storage               = (*InMemoryStorage)(nil)
+	_ StorageLister         = (*InMemoryStorage)(nil)
+)
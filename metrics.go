@@ -0,0 +1,107 @@
+package caddy_blocker
+
+import (
+	"sync"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// blockerMetrics holds the Prometheus collectors registered against one
+// metrics registry.
+type blockerMetrics struct {
+	unauthEvents      *prometheus.CounterVec
+	blocks            prometheus.Counter
+	bypassedAllowlist prometheus.Counter
+	trackedIPs        prometheus.Gauge
+}
+
+// metricsEntry tracks one registry's collectors alongside how many
+// Middleware instances are currently using them, so the last instance to
+// leave a superseded registry (via Cleanup, on a config reload) can
+// unregister them instead of leaking one blockerMetrics plus a strong
+// reference to the old registry per reload.
+type metricsEntry struct {
+	metrics  *blockerMetrics
+	refCount int
+}
+
+// registeredMetrics caches the blockerMetrics already registered per
+// registry. Caddy hands out a new metrics registry on every config
+// reload, so a process-lifetime sync.Once here would only ever register
+// collectors against the first registry and go silent on every reload
+// after that.
+var (
+	registeredMetricsMu sync.Mutex
+	registeredMetrics   = map[*prometheus.Registry]*metricsEntry{}
+)
+
+// newMetrics registers the blocker's collectors against ctx's metrics
+// registry, reusing the same collectors if this registry has already seen
+// them (e.g. multiple blocker instances provisioned from one config).
+// Every call must be paired with a releaseMetrics call from Cleanup.
+func newMetrics(ctx caddy.Context) *blockerMetrics {
+	registry := ctx.GetMetricsRegistry()
+
+	registeredMetricsMu.Lock()
+	defer registeredMetricsMu.Unlock()
+	if e, ok := registeredMetrics[registry]; ok {
+		e.refCount++
+		return e.metrics
+	}
+
+	m := &blockerMetrics{
+		unauthEvents: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "caddy_blocker_unauth_events_total",
+			Help: "Count of responses that counted against a client's block threshold, by status.",
+		}, []string{"status"}),
+		blocks: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "caddy_blocker_blocks_total",
+			Help: "Count of clients blocked on crossing the threshold, plus requests rejected by the denylist.",
+		}),
+		bypassedAllowlist: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "caddy_blocker_bypassed_allowlist_total",
+			Help: "Count of requests that bypassed counting because the client was allowlisted.",
+		}),
+		trackedIPs: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "caddy_blocker_tracked_ips",
+			Help: "Number of client IPs currently tracked by the blocker.",
+		}),
+	}
+	registry.MustRegister(
+		m.unauthEvents,
+		m.blocks,
+		m.bypassedAllowlist,
+		m.trackedIPs,
+	)
+	registeredMetrics[registry] = &metricsEntry{metrics: m, refCount: 1}
+	return m
+}
+
+// releaseMetrics drops one Middleware instance's reference to registry's
+// collectors, unregistering and forgetting them once the last instance
+// using that registry has gone (e.g. the whole config it belonged to was
+// superseded by a reload). Called from Middleware.Cleanup.
+func releaseMetrics(registry *prometheus.Registry) {
+	registeredMetricsMu.Lock()
+	defer registeredMetricsMu.Unlock()
+	e, ok := registeredMetrics[registry]
+	if !ok {
+		return
+	}
+	e.refCount--
+	if e.refCount > 0 {
+		return
+	}
+	registry.Unregister(e.metrics.unauthEvents)
+	registry.Unregister(e.metrics.blocks)
+	registry.Unregister(e.metrics.bypassedAllowlist)
+	registry.Unregister(e.metrics.trackedIPs)
+	delete(registeredMetrics, registry)
+}
+
+// sizer is implemented by rateLimiters that can report how many clients
+// they're currently tracking, for the caddy_blocker_tracked_ips gauge.
+type sizer interface {
+	Len() int
+}
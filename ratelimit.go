@@ -0,0 +1,300 @@
+package caddy_blocker
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/projectdiscovery/expirablelru"
+)
+
+// rateLimiter decides whether a client has crossed the configured
+// threshold. Implementations are independent of how (or whether) counters
+// are persisted across a cluster; only the fixed-window algorithm goes
+// through a Storage backend.
+type rateLimiter interface {
+	// check reports the current block state for ip without recording a
+	// new triggering event.
+	check(ip string) (blocked bool, retryAfter time.Duration, err error)
+
+	// record registers a triggering response for ip and reports whether
+	// the client is now blocked, along with the remaining block time.
+	record(ip string) (blocked bool, retryAfter time.Duration, err error)
+}
+
+// limiterUnblocker is optionally implemented by rateLimiters that track
+// their own state (sliding_window, token_bucket) rather than delegating
+// to a Storage backend, so the admin API can clear a client directly.
+type limiterUnblocker interface {
+	Unblock(ip string) error
+}
+
+// limiterForceBlocker is optionally implemented by rateLimiters that
+// track their own state, so the admin API can force a client into a
+// blocked condition for approximately ttl.
+type limiterForceBlocker interface {
+	ForceBlock(ip string, ttl time.Duration) error
+}
+
+// storageLimiter is the original fixed-window algorithm: a single counter
+// per IP, refreshed on every triggering event, through a pluggable Storage
+// backend so the count can be shared across a cluster.
+type storageLimiter struct {
+	storage        Storage
+	maxUnAuthTimes int
+	blockDuration  time.Duration
+}
+
+func (l *storageLimiter) check(ip string) (bool, time.Duration, error) {
+	count, ttl, err := l.storage.Get(ip)
+	if err != nil || count <= l.maxUnAuthTimes {
+		return false, 0, err
+	}
+	if ttl <= 0 {
+		ttl = l.blockDuration
+	}
+	return true, ttl, nil
+}
+
+func (l *storageLimiter) record(ip string) (bool, time.Duration, error) {
+	count, err := l.storage.Incr(ip, l.blockDuration)
+	if err != nil {
+		return false, 0, err
+	}
+	return count > l.maxUnAuthTimes, l.blockDuration, nil
+}
+
+// Len implements sizer by delegating to the backing storage, when it
+// supports reporting its size.
+func (l *storageLimiter) Len() int {
+	if s, ok := l.storage.(sizer); ok {
+		return s.Len()
+	}
+	return 0
+}
+
+// slidingWindowLimiter blocks once more than maxUnAuthTimes triggering
+// events have landed within the trailing window. Unlike storageLimiter it
+// doesn't refresh a single expiry on every event, so a sustained burst
+// can't keep a client blocked indefinitely.
+type slidingWindowLimiter struct {
+	maxUnAuthTimes int
+	window         time.Duration
+	cache          *expirablelru.Cache // ip -> []time.Time, oldest first
+}
+
+func newSlidingWindowLimiter(maxUnAuthTimes, cacheSize int, window time.Duration) *slidingWindowLimiter {
+	return &slidingWindowLimiter{
+		maxUnAuthTimes: maxUnAuthTimes,
+		window:         window,
+		cache:          expirablelru.NewExpirableLRU(cacheSize, nil, 0, 0),
+	}
+}
+
+// freshEvents returns ip's recorded events that are still within window of
+// now, oldest first.
+func (l *slidingWindowLimiter) freshEvents(ip string, now time.Time) []time.Time {
+	v, ok := l.cache.Get(ip)
+	if !ok {
+		return nil
+	}
+	cutoff := now.Add(-l.window)
+	events := v.([]time.Time)
+	fresh := events[:0:0]
+	for _, e := range events {
+		if e.After(cutoff) {
+			fresh = append(fresh, e)
+		}
+	}
+	return fresh
+}
+
+func (l *slidingWindowLimiter) check(ip string) (bool, time.Duration, error) {
+	events := l.freshEvents(ip, time.Now())
+	if len(events) <= l.maxUnAuthTimes {
+		return false, 0, nil
+	}
+	return true, l.window - time.Since(events[0]), nil
+}
+
+func (l *slidingWindowLimiter) record(ip string) (bool, time.Duration, error) {
+	now := time.Now()
+	events := append(l.freshEvents(ip, now), now)
+	l.cache.Add(ip, events)
+	if len(events) <= l.maxUnAuthTimes {
+		return false, 0, nil
+	}
+	return true, l.window - now.Sub(events[0]), nil
+}
+
+// Len implements sizer.
+func (l *slidingWindowLimiter) Len() int {
+	return l.cache.Len()
+}
+
+// List implements StorageLister, for the admin API. Only clients with at
+// least one fresh event are reported; ExpiresAt is when their oldest
+// fresh event ages out of the window.
+func (l *slidingWindowLimiter) List() ([]BlockedEntry, error) {
+	now := time.Now()
+	keys := l.cache.Keys()
+	entries := make([]BlockedEntry, 0, len(keys))
+	for _, key := range keys {
+		events := l.freshEvents(key.(string), now)
+		if len(events) == 0 {
+			continue
+		}
+		entries = append(entries, BlockedEntry{
+			IP:        key.(string),
+			Count:     len(events),
+			ExpiresAt: events[0].Add(l.window),
+		})
+	}
+	return entries, nil
+}
+
+// Unblock implements limiterUnblocker, for the admin API.
+func (l *slidingWindowLimiter) Unblock(ip string) error {
+	l.cache.Remove(ip)
+	return nil
+}
+
+// ForceBlock implements limiterForceBlocker, for the admin API. It plants
+// enough events to put ip over threshold, all timestamped so that they
+// age out of the window ttl from now.
+func (l *slidingWindowLimiter) ForceBlock(ip string, ttl time.Duration) error {
+	at := time.Now().Add(ttl - l.window)
+	events := make([]time.Time, l.maxUnAuthTimes+1)
+	for i := range events {
+		events[i] = at
+	}
+	l.cache.Add(ip, events)
+	return nil
+}
+
+// tokenBucketState is the value stored per IP by tokenBucketLimiter.
+type tokenBucketState struct {
+	tokens float64
+	last   time.Time
+}
+
+// tokenBucketLimiter blocks once a client has spent its burst of tokens
+// faster than they refill at rate tokens/sec.
+type tokenBucketLimiter struct {
+	rate  float64
+	burst float64
+	cache *expirablelru.Cache // ip -> tokenBucketState
+}
+
+func newTokenBucketLimiter(rate float64, burst, cacheSize int) *tokenBucketLimiter {
+	return &tokenBucketLimiter{
+		rate:  rate,
+		burst: float64(burst),
+		cache: expirablelru.NewExpirableLRU(cacheSize, nil, 0, 0),
+	}
+}
+
+// refill returns ip's bucket state after accounting for tokens earned
+// since it was last touched, without spending a token.
+func (l *tokenBucketLimiter) refill(ip string, now time.Time) tokenBucketState {
+	v, ok := l.cache.Get(ip)
+	if !ok {
+		return tokenBucketState{tokens: l.burst, last: now}
+	}
+	s := v.(tokenBucketState)
+	if elapsed := now.Sub(s.last); elapsed > 0 {
+		s.tokens += elapsed.Seconds() * l.rate
+		if s.tokens > l.burst {
+			s.tokens = l.burst
+		}
+	}
+	s.last = now
+	return s
+}
+
+// retryAfter estimates how long until a negative token balance refills
+// back to zero.
+func (l *tokenBucketLimiter) retryAfter(tokens float64) time.Duration {
+	if l.rate <= 0 || tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-tokens / l.rate * float64(time.Second))
+}
+
+func (l *tokenBucketLimiter) check(ip string) (bool, time.Duration, error) {
+	s := l.refill(ip, time.Now())
+	if s.tokens >= 0 {
+		return false, 0, nil
+	}
+	return true, l.retryAfter(s.tokens), nil
+}
+
+func (l *tokenBucketLimiter) record(ip string) (bool, time.Duration, error) {
+	s := l.refill(ip, time.Now())
+	s.tokens--
+	l.cache.Add(ip, s)
+	if s.tokens >= 0 {
+		return false, 0, nil
+	}
+	return true, l.retryAfter(s.tokens), nil
+}
+
+// Len implements sizer.
+func (l *tokenBucketLimiter) Len() int {
+	return l.cache.Len()
+}
+
+// List implements StorageLister, for the admin API. Only clients with a
+// negative token balance (currently blocked) are reported.
+func (l *tokenBucketLimiter) List() ([]BlockedEntry, error) {
+	now := time.Now()
+	keys := l.cache.Keys()
+	entries := make([]BlockedEntry, 0, len(keys))
+	for _, key := range keys {
+		s := l.refill(key.(string), now)
+		if s.tokens >= 0 {
+			continue
+		}
+		entries = append(entries, BlockedEntry{
+			IP:        key.(string),
+			Count:     int(-s.tokens),
+			ExpiresAt: now.Add(l.retryAfter(s.tokens)),
+		})
+	}
+	return entries, nil
+}
+
+// Unblock implements limiterUnblocker, for the admin API.
+func (l *tokenBucketLimiter) Unblock(ip string) error {
+	l.cache.Remove(ip)
+	return nil
+}
+
+// ForceBlock implements limiterForceBlocker, for the admin API. It sets
+// ip's balance to however negative is needed for retryAfter to be
+// approximately ttl.
+func (l *tokenBucketLimiter) ForceBlock(ip string, ttl time.Duration) error {
+	if l.rate <= 0 {
+		return fmt.Errorf("token_bucket: cannot force-block with a non-positive rate")
+	}
+	l.cache.Add(ip, tokenBucketState{
+		tokens: -ttl.Seconds() * l.rate,
+		last:   time.Now(),
+	})
+	return nil
+}
+
+// Interface guards
+var (
+	_ rateLimiter         = (*storageLimiter)(nil)
+	_ sizer               = (*storageLimiter)(nil)
+	_ rateLimiter         = (*slidingWindowLimiter)(nil)
+	_ sizer               = (*slidingWindowLimiter)(nil)
+	_ StorageLister       = (*slidingWindowLimiter)(nil)
+	_ limiterUnblocker    = (*slidingWindowLimiter)(nil)
+	_ limiterForceBlocker = (*slidingWindowLimiter)(nil)
+	_ rateLimiter         = (*tokenBucketLimiter)(nil)
+	_ sizer               = (*tokenBucketLimiter)(nil)
+	_ StorageLister       = (*tokenBucketLimiter)(nil)
+	_ limiterUnblocker    = (*tokenBucketLimiter)(nil)
+	_ limiterForceBlocker = (*tokenBucketLimiter)(nil)
+)
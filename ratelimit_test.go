@@ -0,0 +1,107 @@
+package caddy_blocker
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSlidingWindowLimiterEmptyWindow(t *testing.T) {
+	l := newSlidingWindowLimiter(2, 10, time.Minute)
+
+	blocked, retryAfter, err := l.check("1.2.3.4")
+	if err != nil || blocked || retryAfter != 0 {
+		t.Fatalf("check on an untouched ip: got (%v, %v, %v), want (false, 0, nil)", blocked, retryAfter, err)
+	}
+}
+
+func TestSlidingWindowLimiterExactlyAtLimit(t *testing.T) {
+	l := newSlidingWindowLimiter(2, 10, time.Minute)
+	ip := "1.2.3.4"
+
+	for i := 0; i < 2; i++ {
+		blocked, _, err := l.record(ip)
+		if err != nil {
+			t.Fatalf("record %d: %v", i, err)
+		}
+		if blocked {
+			t.Fatalf("record %d: blocked at %d events, want unblocked at exactly maxUnAuthTimes", i, i+1)
+		}
+	}
+
+	blocked, retryAfter, err := l.record(ip)
+	if err != nil {
+		t.Fatalf("record: %v", err)
+	}
+	if !blocked || retryAfter <= 0 {
+		t.Fatalf("record past maxUnAuthTimes: got (%v, %v), want blocked with a positive retryAfter", blocked, retryAfter)
+	}
+}
+
+func TestSlidingWindowLimiterClockGoingBackward(t *testing.T) {
+	l := newSlidingWindowLimiter(0, 10, time.Minute)
+	ip := "1.2.3.4"
+
+	// Plant an event that looks like it happened an hour in the future,
+	// as if the wall clock had since jumped backward. It must still
+	// read as fresh rather than being treated as expired.
+	l.cache.Add(ip, []time.Time{time.Now().Add(time.Hour)})
+
+	blocked, retryAfter, err := l.check(ip)
+	if err != nil {
+		t.Fatalf("check: %v", err)
+	}
+	if !blocked || retryAfter <= 0 {
+		t.Fatalf("check after a backward clock jump: got (%v, %v), want blocked with a positive retryAfter", blocked, retryAfter)
+	}
+}
+
+func TestTokenBucketLimiterEmptyWindow(t *testing.T) {
+	l := newTokenBucketLimiter(1, 2, 10)
+
+	blocked, retryAfter, err := l.check("1.2.3.4")
+	if err != nil || blocked || retryAfter != 0 {
+		t.Fatalf("check on an untouched ip: got (%v, %v, %v), want (false, 0, nil)", blocked, retryAfter, err)
+	}
+}
+
+func TestTokenBucketLimiterExactlyAtLimit(t *testing.T) {
+	l := newTokenBucketLimiter(1, 2, 10)
+	ip := "1.2.3.4"
+
+	for i := 0; i < 2; i++ {
+		blocked, _, err := l.record(ip)
+		if err != nil {
+			t.Fatalf("record %d: %v", i, err)
+		}
+		if blocked {
+			t.Fatalf("record %d: blocked with a zero-or-positive balance", i)
+		}
+	}
+
+	blocked, retryAfter, err := l.record(ip)
+	if err != nil {
+		t.Fatalf("record: %v", err)
+	}
+	if !blocked || retryAfter <= 0 {
+		t.Fatalf("record past burst: got (%v, %v), want blocked with a positive retryAfter", blocked, retryAfter)
+	}
+}
+
+func TestTokenBucketLimiterClockGoingBackward(t *testing.T) {
+	l := newTokenBucketLimiter(1, 2, 10)
+	ip := "1.2.3.4"
+
+	// Plant a negative balance timestamped an hour in the future, as if
+	// the wall clock had since jumped backward. refill must not mistake
+	// the negative elapsed time for a long idle period and hand out
+	// tokens it hasn't earned.
+	l.cache.Add(ip, tokenBucketState{tokens: -1, last: time.Now().Add(time.Hour)})
+
+	blocked, retryAfter, err := l.check(ip)
+	if err != nil {
+		t.Fatalf("check: %v", err)
+	}
+	if !blocked || retryAfter <= 0 {
+		t.Fatalf("check after a backward clock jump: got (%v, %v), want still blocked with a positive retryAfter", blocked, retryAfter)
+	}
+}
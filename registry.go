@@ -0,0 +1,33 @@
+package caddy_blocker
+
+import "sync"
+
+// instanceRegistry tracks every provisioned Middleware instance so the
+// admin API, which has no direct handle on the HTTP handler chain, can
+// reach their storage.
+var instanceRegistry = struct {
+	mu        sync.Mutex
+	instances map[uint64]*Middleware
+}{instances: map[uint64]*Middleware{}}
+
+func registerInstance(m *Middleware) {
+	instanceRegistry.mu.Lock()
+	defer instanceRegistry.mu.Unlock()
+	instanceRegistry.instances[m.id] = m
+}
+
+func unregisterInstance(id uint64) {
+	instanceRegistry.mu.Lock()
+	defer instanceRegistry.mu.Unlock()
+	delete(instanceRegistry.instances, id)
+}
+
+func instancesSnapshot() []*Middleware {
+	instanceRegistry.mu.Lock()
+	defer instanceRegistry.mu.Unlock()
+	out := make([]*Middleware, 0, len(instanceRegistry.instances))
+	for _, m := range instanceRegistry.instances {
+		out = append(out, m)
+	}
+	return out
+}
@@ -0,0 +1,32 @@
+package caddy_blocker
+
+import "time"
+
+// Storage is implemented by pluggable backends that track per-client
+// failure counts so blocks can be enforced, and inspected, consistently
+// across a cluster of Caddy instances.
+type Storage interface {
+	// Incr increments the counter for ip, (re)arms its expiry for ttl,
+	// and returns the updated count.
+	Incr(ip string, ttl time.Duration) (count int, err error)
+
+	// Get returns the current count for ip and the time remaining until
+	// it expires. A count of zero means ip has no recorded failures.
+	Get(ip string) (count int, ttl time.Duration, err error)
+
+	// Delete clears ip's counter, unblocking it immediately.
+	Delete(ip string) error
+}
+
+// BlockedEntry describes one client's current counter, for the admin API.
+type BlockedEntry struct {
+	IP        string    `json:"ip"`
+	Count     int       `json:"count"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// StorageLister is optionally implemented by Storage backends that can
+// enumerate their tracked IPs.
+type StorageLister interface {
+	List() ([]BlockedEntry, error)
+}